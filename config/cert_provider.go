@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"crypto/x509"
+
+	"github.com/golang/glog"
+)
+
+// CertProvider supplies a pool of CA certificates to trust, plus a hook to
+// be notified when that pool changes. It exists so that trust material can
+// come from more than just local files: env-var-embedded PEM bundles today,
+// and SPIFFE Workload API or Vault PKI providers in the future, without
+// HTTPClientFactory's construction needing to know about any of them.
+type CertProvider interface {
+	// RootCAs returns this provider's current pool of trusted CA
+	// certificates. Implementations may re-read their backing source on
+	// every call rather than caching, since callers are expected to control
+	// their own polling/caching policy.
+	RootCAs(ctx context.Context) (*x509.CertPool, error)
+
+	// Subscribe registers a callback to be invoked whenever this provider
+	// learns its pool has changed out-of-band (e.g. a push notification
+	// from a secrets backend). Providers with no such out-of-band signal
+	// may treat this as a no-op; callers that need freshness from those
+	// providers are expected to poll RootCAs themselves.
+	Subscribe(onUpdate func(*x509.CertPool))
+}
+
+// FileCertProvider is the CertProvider backing anax's original hard-coded
+// trust loading: the directory of certs at Edge.CACertsPath, the management
+// hub cert named by the ManagementHubCertPath env var, and
+// AgreementBot.CSSSSLCert.
+type FileCertProvider struct {
+	hConfig HorizonConfig
+}
+
+// NewFileCertProvider builds a FileCertProvider reading from the locations
+// configured on hConfig.
+func NewFileCertProvider(hConfig HorizonConfig) *FileCertProvider {
+	return &FileCertProvider{hConfig: hConfig}
+}
+
+func (p *FileCertProvider) RootCAs(_ context.Context) (*x509.CertPool, error) {
+	return buildCACertPool(p.hConfig)
+}
+
+// Subscribe is a no-op: FileCertProvider has no out-of-band change signal of
+// its own. Callers that want to react to file changes should poll RootCAs
+// or watch the filesystem themselves, as TrustStoreWatcher does.
+func (p *FileCertProvider) Subscribe(_ func(*x509.CertPool)) {}
+
+// EnvCertProvider reads a PEM-encoded CA bundle directly out of an
+// environment variable, which is convenient in containerized deploys where
+// mounting a cert file into the container is awkward.
+type EnvCertProvider struct {
+	envVar string
+}
+
+// NewEnvCertProvider builds an EnvCertProvider that reads its PEM bundle
+// from the given environment variable on every RootCAs call.
+func NewEnvCertProvider(envVar string) *EnvCertProvider {
+	return &EnvCertProvider{envVar: envVar}
+}
+
+func (p *EnvCertProvider) RootCAs(_ context.Context) (*x509.CertPool, error) {
+	pem := os.Getenv(p.envVar)
+	if pem == "" {
+		return x509.NewCertPool(), nil
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM([]byte(pem)); !ok {
+		return nil, fmt.Errorf("failed to parse PEM CA bundle from env var %v", p.envVar)
+	}
+	glog.V(4).Infof("Read CA certs from env var %v", p.envVar)
+
+	return pool, nil
+}
+
+// Subscribe is a no-op: env vars don't change for the lifetime of a
+// process, so there is no out-of-band update to notify about.
+func (p *EnvCertProvider) Subscribe(_ func(*x509.CertPool)) {}
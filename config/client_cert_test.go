@@ -0,0 +1,126 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertKeyPair generates a self-signed cert/key pair with the given
+// serial number (so successive pairs are distinguishable) and writes them as
+// PEM files under dir, returning their paths.
+func writeCertKeyPair(t *testing.T, dir string, serial int64) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "anax-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create test cert: %v", err)
+	}
+
+	certPath = filepath.Join(dir, "client.crt")
+	keyPath = filepath.Join(dir, "client.key")
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write test cert: %v", err)
+	}
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyPath, keyBytes, 0600); err != nil {
+		t.Fatalf("failed to write test key: %v", err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestNewClientCertSourceRequiresBothOrNeitherPath(t *testing.T) {
+	if src, err := newClientCertSource("", ""); err != nil || src != nil {
+		t.Errorf("expected (nil, nil) when neither path is set, got (%v, %v)", src, err)
+	}
+
+	if _, err := newClientCertSource("cert.pem", ""); err == nil {
+		t.Errorf("expected an error when only a cert path is set")
+	}
+
+	if _, err := newClientCertSource("", "key.pem"); err == nil {
+		t.Errorf("expected an error when only a key path is set")
+	}
+}
+
+func TestClientCertSourceCachesUntilMtimeChanges(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertKeyPair(t, dir, 1)
+
+	src, err := newClientCertSource(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("newClientCertSource failed: %v", err)
+	}
+
+	first, err := src.getClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("getClientCertificate failed: %v", err)
+	}
+
+	second, err := src.getClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("getClientCertificate failed: %v", err)
+	}
+	if first != second {
+		t.Errorf("expected getClientCertificate to return the cached *tls.Certificate when neither file's mtime has changed")
+	}
+
+	// Overwrite the cert/key with a different pair and move the mtime forward
+	// (os.Chtimes rather than relying on the filesystem's mtime resolution,
+	// which can be too coarse to register a change within a fast test run).
+	_, _ = writeCertKeyPair(t, dir, 2)
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(certPath, future, future); err != nil {
+		t.Fatalf("failed to bump cert mtime: %v", err)
+	}
+	if err := os.Chtimes(keyPath, future, future); err != nil {
+		t.Fatalf("failed to bump key mtime: %v", err)
+	}
+
+	third, err := src.getClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("getClientCertificate failed: %v", err)
+	}
+	if third == first {
+		t.Errorf("expected getClientCertificate to reload once the cert/key mtimes changed")
+	}
+}
+
+func TestClientCertSourceErrorsOnMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertKeyPair(t, dir, 1)
+	if err := os.Remove(certPath); err != nil {
+		t.Fatalf("failed to remove test cert: %v", err)
+	}
+
+	src, err := newClientCertSource(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("newClientCertSource failed: %v", err)
+	}
+
+	if _, err := src.getClientCertificate(nil); err == nil {
+		t.Errorf("expected an error when the cert file is missing")
+	}
+}
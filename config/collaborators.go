@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -25,8 +24,14 @@ type Collaborators struct {
 	KeyFileNamesFetcher *KeyFileNamesFetcher
 }
 
-func NewCollaborators(hConfig HorizonConfig) (*Collaborators, error) {
-	httpClientFactory, err := newHTTPClientFactory(hConfig)
+// NewCollaborators builds the standard set of collaborators. extraCertProviders,
+// if any, are merged into the HTTPClientFactory's trust store alongside the
+// built-in file/env providers -- this is the extension point downstream forks
+// should use to add their own CertProvider (e.g. SPIFFE or Vault PKI); see
+// HTTPClientFactory.CertProviders for why appending to that field after the
+// fact does not work.
+func NewCollaborators(hConfig HorizonConfig, extraCertProviders ...CertProvider) (*Collaborators, error) {
+	httpClientFactory, err := newHTTPClientFactory(hConfig, extraCertProviders...)
 	if err != nil {
 		return nil, err
 	}
@@ -50,6 +55,19 @@ type HTTPClientFactory struct {
 	NewHTTPClient func(overrideTimeoutS *uint) *http.Client
 	RetryCount    int // number of retries for tranport error.
 	RetryInterval int // retry interval in second for tranport error. The default is 10 seconds.
+
+	// CertProviders is the set of trust sources the factory merged at
+	// construction time, exposed for introspection. It is NOT a live
+	// extension point: the trust store watcher is already built and its
+	// background goroutine already running by the time newHTTPClientFactory
+	// returns, so appending to this slice afterward has no effect.
+	// Downstream forks that want to add their own CertProvider (e.g. SPIFFE
+	// or Vault PKI) should pass it to NewCollaborators/newHTTPClientFactory
+	// via extraCertProviders instead.
+	CertProviders []CertProvider
+
+	trustStore *TrustStoreWatcher
+	transports *transportCache
 }
 
 // default retry interval is 10 seconds
@@ -61,6 +79,28 @@ func (h *HTTPClientFactory) GetRetryInterval() int {
 	}
 }
 
+// Close releases resources held by this factory, including idle connections
+// on every cached *http.Transport and the trust store watcher's background
+// goroutine. Callers should invoke this during anax shutdown.
+func (h *HTTPClientFactory) Close() {
+	if h.transports != nil {
+		h.transports.closeAll()
+	}
+	if h.trustStore != nil {
+		h.trustStore.Stop()
+	}
+}
+
+// LastReloadErr returns the error (if any) from the most recent attempt to
+// reload the CA trust store from disk. It returns nil if the trust store has
+// never failed to reload, including when it has never needed to reload.
+func (h *HTTPClientFactory) LastReloadErr() error {
+	if h.trustStore == nil {
+		return nil
+	}
+	return h.trustStore.LastReloadErr()
+}
+
 type KeyFileNamesFetcher struct {
 	// get all the pem file names from the pulic key path and user key path.
 	// if the publicKeyPath is a file name all the *.pem files within the same directory will be returned.
@@ -77,53 +117,73 @@ func (f *HTTPClientFactory) WrappedNewHTTPClient() func(*uint) *http.Client {
 	}
 }
 
-// TODO: use a pool of clients instead of creating them forever
-func newHTTPClientFactory(hConfig HorizonConfig) (*HTTPClientFactory, error) {
-	var derCerts, pemCerts []byte
-	var cerCerts [][]byte
-	var mgmtHubBytes []byte
-	var cssCaBytes []byte
+// caCertExtensions are the file extensions that buildCACertPool will look for
+// when walking a CA certs directory.
+var caCertExtensions = []string{".der", ".pem", ".crt", ".cer"}
+
+// loadCACertsFromDir walks dir and returns the raw bytes of every CA cert
+// file it finds, grouped by encoding, so that callers can fold them into
+// whichever *x509.CertPool they're building. It's shared by buildCACertPool
+// and the per-host profile loader in host_tls_profile.go.
+func loadCACertsFromDir(dir string) (pemCerts, derCerts []byte, cerCerts [][]byte, err error) {
+	if dir == "" {
+		return nil, nil, nil, nil
+	}
 
-	if hConfig.Edge.CACertsPath != "" {
-		var err error
-		err = filepath.Walk(hConfig.Edge.CACertsPath,
-			func(path string, f os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !f.IsDir() {
-					ext := filepath.Ext(path)
-					ok := func(ext string) bool {
-						extensions := []string{".der", ".pem", ".crt", ".cer"}
-						for _, extension := range extensions {
-							if ext == extension {
-								return true
-							}
-						}
-						return false
-					}(ext)
-					if ok {
-						caBytes, err := ioutil.ReadFile(path)
-						if err != nil {
-							return fmt.Errorf("Failed to read CACertsFile: %v", path)
+	err = filepath.Walk(dir,
+		func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !f.IsDir() {
+				ext := filepath.Ext(path)
+				ok := func(ext string) bool {
+					for _, extension := range caCertExtensions {
+						if ext == extension {
+							return true
 						}
-						switch ext {
-						case ".der":
-							derCerts = append(derCerts, caBytes...)
-						case ".pem":
-							pemCerts = append(pemCerts, caBytes...)
-						case ".cer", ".crt":
-							cerCerts = append(cerCerts, caBytes)
+					}
+					return false
+				}(ext)
+				if ok {
+					caBytes, err := ioutil.ReadFile(path)
+					if err != nil {
+						return fmt.Errorf("Failed to read CACertsFile: %v", path)
+					}
+					switch ext {
+					case ".der":
+						derCerts = append(derCerts, caBytes...)
+					case ".pem":
+						pemCerts = append(pemCerts, caBytes...)
+					case ".cer", ".crt":
+						cerCerts = append(cerCerts, caBytes)
 
-						}
-						glog.V(4).Infof("Read CA certs from provided file %v", path)
 					}
+					glog.V(4).Infof("Read CA certs from provided file %v", path)
 				}
-				return nil
-			})
-		if err != nil {
-			return nil, fmt.Errorf("Failed to read CACertsFiles from: %v", hConfig.Edge.CACertsPath)
-		}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to read CACertsFiles from: %v", dir)
+	}
+
+	return pemCerts, derCerts, cerCerts, nil
+}
+
+// buildCACertPool reads all of the CA trust material anax is configured to
+// use -- the directory of certs pointed to by Edge.CACertsPath, the
+// management hub cert named by the ManagementHubCertPath env var, and the
+// agbot's CSS SSL cert -- and returns an assembled *x509.CertPool. This is
+// factored out of newHTTPClientFactory so that TrustStoreWatcher can call it
+// again whenever one of those sources changes on disk.
+func buildCACertPool(hConfig HorizonConfig) (*x509.CertPool, error) {
+	var mgmtHubBytes []byte
+	var cssCaBytes []byte
+
+	pemCerts, derCerts, cerCerts, err := loadCACertsFromDir(hConfig.Edge.CACertsPath)
+	if err != nil {
+		return nil, err
 	}
 
 	// A custom TLS certificate can be set in the /var/default/horizon file. Anax sees this value as
@@ -154,11 +214,6 @@ func newHTTPClientFactory(hConfig HorizonConfig) (*HTTPClientFactory, error) {
 		glog.V(4).Infof("Read CSS cert from provided file %v", hConfig.AgreementBot.CSSSSLCert)
 	}
 
-	var tlsConf tls.Config
-	tlsConf.InsecureSkipVerify = false
-	// do not allow negotiation to previous versions of TLS
-	tlsConf.MinVersion = tls.VersionTLS12
-
 	var certPool *x509.CertPool
 
 	if hConfig.Edge.TrustSystemCACerts || hConfig.AgreementBot.CSSSSLCert != "" {
@@ -203,10 +258,66 @@ func newHTTPClientFactory(hConfig HorizonConfig) (*HTTPClientFactory, error) {
 		certPool.AppendCertsFromPEM(cssCaBytes)
 	}
 
-	tlsConf.RootCAs = certPool
+	return certPool, nil
+}
+
+// newHTTPClientFactory builds the factory's trust store from the built-in
+// file/env providers plus any extraCertProviders, before the trust store
+// watcher goroutine is started -- see HTTPClientFactory.CertProviders for why
+// providers must be supplied here rather than appended afterward.
+func newHTTPClientFactory(hConfig HorizonConfig, extraCertProviders ...CertProvider) (*HTTPClientFactory, error) {
+	certProviders := []CertProvider{NewFileCertProvider(hConfig)}
+	if hConfig.Edge.CACertsEnvVar != "" {
+		certProviders = append(certProviders, NewEnvCertProvider(hConfig.Edge.CACertsEnvVar))
+	}
+	certProviders = append(certProviders, extraCertProviders...)
+
+	var tlsConf tls.Config
+	// do not allow negotiation to previous versions of TLS
+	tlsConf.MinVersion = tls.VersionTLS12
+
+	trustStore, err := newTrustStoreWatcher(hConfig, certProviders)
+	if err != nil {
+		return nil, err
+	}
+
+	// mTLS: anax can authenticate itself to the Exchange/CSS/agbot
+	// endpoints with a client certificate. Edge and AgreementBot each carry
+	// their own cert/key pair since a single process only ever acts as one
+	// of the two; whichever is configured wins, with Edge taking
+	// precedence since it is the more common case.
+	clientCertPath, clientKeyPath := hConfig.Edge.ClientCertPath, hConfig.Edge.ClientKeyPath
+	if clientCertPath == "" && clientKeyPath == "" {
+		clientCertPath, clientKeyPath = hConfig.AgreementBot.ClientCertPath, hConfig.AgreementBot.ClientKeyPath
+	}
+	clientCertSrc, err := newClientCertSource(clientCertPath, clientKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if clientCertSrc != nil {
+		tlsConf.GetClientCertificate = clientCertSrc.getClientCertificate
+	}
 
 	tlsConf.BuildNameToCertificate()
 
+	// baseDialTLS dials with ServerName set to whatever host is actually
+	// being connected to and verifies the presented chain against the trust
+	// store's current pools for that host; see
+	// TrustStoreWatcher.verifyPeerCertificate for why this runs per-dial
+	// instead of as a single shared tls.Config.VerifyPeerCertificate.
+	baseDialTLS := trustStore.DialTLSContext(&tlsConf)
+
+	transports := newTransportCache(&tlsConf)
+	if len(hConfig.HostTLSProfiles) > 0 {
+		hostDialer, err := newHostTLSDialer(hConfig, baseDialTLS)
+		if err != nil {
+			return nil, err
+		}
+		transports.dialTLSContext = hostDialer.DialTLSContext
+	} else {
+		transports.dialTLSContext = baseDialTLS
+	}
+
 	clientFunc := func(overrideTimeoutS *uint) *http.Client {
 		var timeoutS uint
 
@@ -220,19 +331,8 @@ func newHTTPClientFactory(hConfig HorizonConfig) (*HTTPClientFactory, error) {
 			// remember that this timouet is for the whole request, including
 			// body reading. This means that you must set the timeout according
 			// to the total payload size you expect
-			Timeout: time.Second * time.Duration(timeoutS),
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   20 * time.Second,
-					KeepAlive: 60 * time.Second,
-				}).Dial,
-				TLSHandshakeTimeout:   20 * time.Second,
-				ResponseHeaderTimeout: 20 * time.Second,
-				ExpectContinueTimeout: 8 * time.Second,
-				MaxIdleConns:          MaxHTTPIdleConnections,
-				IdleConnTimeout:       HTTPIdleConnectionTimeoutS * time.Second,
-				TLSClientConfig:       &tlsConf,
-			},
+			Timeout:   time.Second * time.Duration(timeoutS),
+			Transport: transports.get(timeoutS),
 		}
 	}
 
@@ -240,6 +340,9 @@ func newHTTPClientFactory(hConfig HorizonConfig) (*HTTPClientFactory, error) {
 		NewHTTPClient: clientFunc,
 		RetryCount:    0,
 		RetryInterval: 10,
+		CertProviders: certProviders,
+		trustStore:    trustStore,
+		transports:    transports,
 	}, nil
 }
 
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// HostTLSProfile lets a single process talk to hosts that don't share a
+// trust anchor -- e.g. a self-signed dev Exchange and a production CSS with
+// a publicly-rooted cert -- without merging all of their CA material into
+// one pool. Keys into the HostTLSProfiles map are matched against the
+// hostname anax actually dials (http.Transport.DialTLSContext only ever
+// sees a "host:port" network address, never a path), so a key may be a bare
+// hostname ("css.example.com"), a "host:port" pair, or a URL with a scheme
+// and/or path ("https://css.example.com/"), which is normalized down to
+// just its host before matching. A profile for a host with a publicly-rooted
+// cert only needs TrustSystemCACerts set, the same as Edge.TrustSystemCACerts
+// does for the default trust store; CACertsPath is for trust material that
+// isn't in the distribution-provided CA bundle.
+type HostTLSProfile struct {
+	CACertsPath            string
+	TrustSystemCACerts     bool
+	ClientCertPath         string
+	ClientKeyPath          string
+	MinTLSVersion          uint16
+	AllowedServerCNs       []string
+	AllowedServerHostnames []string
+}
+
+// dialTLSContextFunc is the http.Transport.DialTLSContext shape.
+type dialTLSContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// hostTLSDialer implements a DialTLSContext that picks the right trust
+// material for the target host out of a set of HostTLSProfiles, falling
+// back to another dialer (normally the default trust store's) for any host
+// that doesn't match a profile.
+type hostTLSDialer struct {
+	fallback dialTLSContextFunc
+
+	// profiles is keyed by the normalized (scheme/path/port stripped)
+	// hostname from HostTLSProfiles.
+	profiles map[string]*hostProfileTrust
+}
+
+// hostProfileTrust holds the built trust material for one HostTLSProfile.
+// ServerName/VerifyPeerCertificate are intentionally left unset on tlsConf
+// itself -- they depend on the actual host being dialed, which isn't known
+// until DialTLSContext runs, so each dial clones tlsConf and fills them in.
+type hostProfileTrust struct {
+	tlsConf          *tls.Config
+	pool             *x509.CertPool
+	allowedCNs       []string
+	allowedHostnames []string
+}
+
+// newHostTLSDialer builds trust material per profile in
+// hConfig.HostTLSProfiles. fallback is used for any host that doesn't match
+// a profile.
+func newHostTLSDialer(hConfig HorizonConfig, fallback dialTLSContextFunc) (*hostTLSDialer, error) {
+	d := &hostTLSDialer{
+		fallback: fallback,
+		profiles: make(map[string]*hostProfileTrust, len(hConfig.HostTLSProfiles)),
+	}
+
+	for key, profile := range hConfig.HostTLSProfiles {
+		trust, err := buildHostProfileTrust(profile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build TLS profile for %v: %v", key, err)
+		}
+		d.profiles[normalizeHostKey(key)] = trust
+	}
+
+	return d, nil
+}
+
+// normalizeHostKey strips an optional scheme, path, and port off of a
+// HostTLSProfile map key so that it can be compared directly against the
+// hostname anax actually dials.
+func normalizeHostKey(key string) string {
+	if idx := strings.Index(key, "://"); idx >= 0 {
+		key = key[idx+len("://"):]
+	}
+	if idx := strings.Index(key, "/"); idx >= 0 {
+		key = key[:idx]
+	}
+	if h, _, err := net.SplitHostPort(key); err == nil {
+		key = h
+	}
+	return key
+}
+
+// buildHostProfileTrust builds the trust material for a single
+// HostTLSProfile: its own CA pool (the system pool only if
+// TrustSystemCACerts is set, and no merging with other profiles or the
+// default trust store), optional client certificate, and
+// its CN/hostname allow-lists, all to be applied against whatever host is
+// actually dialed.
+func buildHostProfileTrust(profile HostTLSProfile) (*hostProfileTrust, error) {
+	var pool *x509.CertPool
+	if profile.TrustSystemCACerts {
+		var err error
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		pool = x509.NewCertPool()
+	}
+
+	pemCerts, derCerts, cerCerts, err := loadCACertsFromDir(profile.CACertsPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(pemCerts) != 0 {
+		pool.AppendCertsFromPEM(pemCerts)
+	}
+	if len(derCerts) != 0 {
+		if parsed, err := x509.ParseCertificates(derCerts); err == nil {
+			for _, c := range parsed {
+				pool.AddCert(c)
+			}
+		}
+	}
+	for _, caBytes := range cerCerts {
+		if len(caBytes) != 0 {
+			if ok := pool.AppendCertsFromPEM(caBytes); !ok {
+				if cerCert, err := x509.ParseCertificate(caBytes); err == nil {
+					pool.AddCert(cerCert)
+				}
+			}
+		}
+	}
+
+	minVersion := profile.MinTLSVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	conf := &tls.Config{
+		MinVersion: minVersion,
+	}
+
+	clientCertSrc, err := newClientCertSource(profile.ClientCertPath, profile.ClientKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if clientCertSrc != nil {
+		conf.GetClientCertificate = clientCertSrc.getClientCertificate
+	}
+
+	return &hostProfileTrust{
+		tlsConf:          conf,
+		pool:             pool,
+		allowedCNs:       profile.AllowedServerCNs,
+		allowedHostnames: profile.AllowedServerHostnames,
+	}, nil
+}
+
+// verifyProfileCertificate verifies the presented chain against pool,
+// requiring it to also be valid for host, then enforces the profile's
+// CN/hostname allow-list, if any, as an additional restriction on top.
+func verifyProfileCertificate(rawCerts [][]byte, pool *x509.CertPool, host string, allowedCNs, allowedHostnames []string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no peer certificates presented")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		DNSName:       host,
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("failed to verify peer certificate against host TLS profile trust store for host %v: %v", host, err)
+	}
+
+	return verifyAllowedIdentity(certs[0], allowedCNs, allowedHostnames)
+}
+
+// DialTLSContext dials addr using whichever profile matches its host, or
+// falls back to d.fallback if none do. It's installed as
+// http.Transport.DialTLSContext.
+func (d *hostTLSDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	trust, ok := d.profiles[host]
+	if !ok {
+		return d.fallback(ctx, network, addr)
+	}
+
+	// Each dial gets its own clone so that concurrent dials don't race on
+	// ServerName/VerifyPeerCertificate, and so that chain verification
+	// (always done ourselves, to keep hostname checking mandatory rather
+	// than conditional on an allow-list being configured) has the actual
+	// dialed host in scope.
+	conf := trust.tlsConf.Clone()
+	conf.ServerName = host
+	conf.InsecureSkipVerify = true
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyProfileCertificate(rawCerts, trust.pool, host, trust.allowedCNs, trust.allowedHostnames)
+	}
+
+	rawConn, err := (&net.Dialer{
+		Timeout:   20 * time.Second,
+		KeepAlive: 60 * time.Second,
+	}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(rawConn, conf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
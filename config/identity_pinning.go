@@ -0,0 +1,35 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// verifyAllowedIdentity is defense-in-depth against a compromised or overly
+// broad CA in the trust bundle, applied on top of the mandatory hostname
+// verification callers already perform during chain verification (see
+// TrustStoreWatcher.verifyPeerCertificate and verifyProfileCertificate):
+// even once a server certificate chains to a trusted root *and* matches the
+// dialed hostname, it must also present one of the allowed identities
+// before the handshake is accepted. An empty allowedCNs/allowedHostnames
+// pair preserves today's behavior of trusting any certificate that passes
+// hostname-checked chain verification.
+func verifyAllowedIdentity(leaf *x509.Certificate, allowedCNs, allowedHostnames []string) error {
+	if len(allowedCNs) == 0 && len(allowedHostnames) == 0 {
+		return nil
+	}
+
+	for _, cn := range allowedCNs {
+		if leaf.Subject.CommonName == cn {
+			return nil
+		}
+	}
+
+	for _, allowed := range allowedHostnames {
+		if leaf.VerifyHostname(allowed) == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("server certificate with CN %q does not match any allowed CN or hostname (allowed CNs: %v, allowed hostnames: %v)", leaf.Subject.CommonName, allowedCNs, allowedHostnames)
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// transportCache lazily builds one *http.Transport per distinct effective
+// request timeout and hands it out to every caller that asks for that
+// timeout, so that connections to the Exchange/CSS get reused across calls
+// instead of each NewHTTPClient call paying a fresh TCP/TLS handshake. Only
+// the per-client http.Client.Timeout varies between callers; everything
+// about the Transport itself -- including the shared TLS config -- is
+// identical, so it's safe to share by value of the timeout alone.
+type transportCache struct {
+	tlsConf *tls.Config
+
+	// dialTLSContext, if set, overrides tlsConf as the source of per-host
+	// TLS behavior (used for HostTLSProfiles); see host_tls_profile.go.
+	dialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu         sync.RWMutex
+	transports map[uint]*http.Transport
+}
+
+func newTransportCache(tlsConf *tls.Config) *transportCache {
+	return &transportCache{
+		tlsConf:    tlsConf,
+		transports: make(map[uint]*http.Transport),
+	}
+}
+
+// get returns the cached *http.Transport for timeoutS, building and caching
+// one if this is the first request for that timeout.
+func (c *transportCache) get(timeoutS uint) *http.Transport {
+	c.mu.RLock()
+	t, ok := c.transports[timeoutS]
+	c.mu.RUnlock()
+	if ok {
+		return t
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another goroutine may have built it while we waited for the write lock
+	if t, ok := c.transports[timeoutS]; ok {
+		return t
+	}
+
+	t = &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   20 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   20 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		ExpectContinueTimeout: 8 * time.Second,
+		MaxIdleConns:          MaxHTTPIdleConnections,
+		IdleConnTimeout:       HTTPIdleConnectionTimeoutS * time.Second,
+		TLSClientConfig:       c.tlsConf,
+	}
+	if c.dialTLSContext != nil {
+		// DialTLSContext takes precedence over TLSClientConfig/TLSHandshakeTimeout
+		// in net/http, letting each host profile dial with its own trust anchor.
+		t.DialTLSContext = c.dialTLSContext
+	}
+	c.transports[timeoutS] = t
+
+	return t
+}
+
+// closeAll calls CloseIdleConnections on every transport this cache has
+// built.
+func (c *transportCache) closeAll() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, t := range c.transports {
+		t.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTransportCacheGetCachesByTimeout(t *testing.T) {
+	c := newTransportCache(&tls.Config{})
+
+	a1 := c.get(5)
+	a2 := c.get(5)
+	if a1 != a2 {
+		t.Errorf("expected repeat calls with the same timeout to return the cached *http.Transport")
+	}
+
+	b := c.get(10)
+	if b == a1 {
+		t.Errorf("expected a different timeout to get its own *http.Transport")
+	}
+}
+
+func TestTransportCacheGetConcurrentSameTimeout(t *testing.T) {
+	c := newTransportCache(&tls.Config{})
+
+	var wg sync.WaitGroup
+	results := make([]*http.Transport, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.get(5)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 1; i < len(results); i++ {
+		if results[i] != results[0] {
+			t.Errorf("expected concurrent get(5) calls to all return the same *http.Transport")
+		}
+	}
+}
+
+// countingListener counts how many TCP connections the server has accepted,
+// so that tests can tell whether a request reused an idle connection or had
+// to dial a new one.
+type countingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	count int
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.count++
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *countingListener) acceptCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func TestTransportCacheCloseAllClosesIdleConnections(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	listener := &countingListener{Listener: server.Listener}
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	c := newTransportCache(&tls.Config{})
+	client := &http.Client{Transport: c.get(5)}
+
+	get := func() {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	get()
+	if got := listener.acceptCount(); got != 1 {
+		t.Fatalf("expected the second request to reuse the idle connection from the first, got %v accepted connections", got)
+	}
+
+	c.closeAll()
+
+	get()
+	if got := listener.acceptCount(); got != 2 {
+		t.Errorf("expected closeAll to close the idle connection, forcing a new one to be dialed, got %v accepted connections", got)
+	}
+}
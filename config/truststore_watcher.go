@@ -0,0 +1,341 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// defaultTrustStorePollIntervalS is used as a fallback reload interval on
+// filesystems (e.g. some overlay/network mounts) where fsnotify events are
+// unreliable or unsupported.
+const defaultTrustStorePollIntervalS = 30
+
+// TrustStoreWatcher polls a set of CertProviders -- by default just the
+// locations that anax has always loaded its CA trust material from -- and
+// keeps a pool of trusted certs per provider up to date, so that rotated CA
+// bundles can be picked up without restarting anax. A certificate is
+// trusted if any one of the configured providers trusts it.
+type TrustStoreWatcher struct {
+	hConfig   HorizonConfig
+	providers []CertProvider
+
+	mu      sync.RWMutex
+	pools   []*x509.CertPool
+	lastErr error
+
+	watchDirs []string
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// newTrustStoreWatcher starts a goroutine that watches the filesystem
+// locations used by providers and keeps each provider's pool up to date. It
+// also subscribes to each provider so that providers with their own
+// out-of-band update signal (e.g. a future SPIFFE/Vault provider) can push a
+// refresh immediately rather than waiting for the next poll.
+func newTrustStoreWatcher(hConfig HorizonConfig, providers []CertProvider) (*TrustStoreWatcher, error) {
+	w := &TrustStoreWatcher{
+		hConfig:   hConfig,
+		providers: providers,
+		pools:     make([]*x509.CertPool, len(providers)),
+		stopCh:    make(chan struct{}),
+	}
+	w.watchDirs = w.trustStoreDirs()
+
+	for i, p := range providers {
+		pool, err := p.RootCAs(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		w.pools[i] = pool
+	}
+
+	for i, p := range providers {
+		i := i
+		p.Subscribe(func(pool *x509.CertPool) {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.pools[i] = pool
+			glog.V(3).Infof("TrustStoreWatcher: provider %T pushed an updated trust pool", w.providers[i])
+		})
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// CertPool returns the first provider's current pool (normally
+// FileCertProvider's), for consumers that just want "the trust store"
+// rather than per-provider granularity. Certs held only by the other
+// providers are not in it, since x509.CertPool doesn't support enumerating
+// its contents to build a union; verifyPeerCertificate, which checks every
+// provider's pool individually, is what makes the actual trust decisions.
+func (w *TrustStoreWatcher) CertPool() *x509.CertPool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if len(w.pools) > 0 {
+		return w.pools[0]
+	}
+	return x509.NewCertPool()
+}
+
+// LastReloadErr returns the error from the most recent failed reload
+// attempt, or nil if the last attempt (or every attempt so far) succeeded.
+func (w *TrustStoreWatcher) LastReloadErr() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.lastErr
+}
+
+// Stop shuts down the watcher's background goroutine. It is safe to call
+// more than once.
+func (w *TrustStoreWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+}
+
+// DialTLSContext returns a function suitable for http.Transport.DialTLSContext
+// that dials addr and performs the TLS handshake against a per-dial clone of
+// baseConf with ServerName set to the actual target host. baseConf itself
+// must not carry RootCAs/verification settings that would be evaluated
+// before our VerifyPeerCertificate override runs; see verifyPeerCertificate
+// for how the trust pool and hostname are actually checked.
+func (w *TrustStoreWatcher) DialTLSContext(baseConf *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+
+		conf := baseConf.Clone()
+		conf.ServerName = host
+		// RootCAs are swapped out from under us whenever the trust store
+		// watcher detects a change on disk, so normal chain verification is
+		// disabled here in favor of verifying against whatever pools the
+		// watcher currently holds, with ServerName threaded through so
+		// hostname verification still happens.
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return w.verifyPeerCertificate(rawCerts, host)
+		}
+
+		rawConn, err := (&net.Dialer{
+			Timeout:   20 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn := tls.Client(rawConn, conf)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+}
+
+// verifyPeerCertificate verifies the presented chain against each
+// provider's pool in turn, accepting the chain if any one of them trusts it
+// for the given host, and then enforces Edge.AllowedServerCNs/
+// AllowedServerHostnames identity pinning on top, if configured. Hostname
+// verification against host is mandatory -- it runs as part of each pool's
+// chain check below, not only when an allow-list is configured -- since
+// identity pinning is meant to further restrict an already-valid chain, not
+// to be the only thing standing between a stolen CA and a MITM.
+func (w *TrustStoreWatcher) verifyPeerCertificate(rawCerts [][]byte, host string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no peer certificates presented")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	w.mu.RLock()
+	pools := append([]*x509.CertPool{}, w.pools...)
+	w.mu.RUnlock()
+
+	var lastErr error
+	chainTrusted := false
+	for _, pool := range pools {
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			DNSName:       host,
+		}
+		if _, err := certs[0].Verify(opts); err == nil {
+			chainTrusted = true
+			break
+		} else {
+			lastErr = err
+		}
+	}
+
+	if !chainTrusted {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no trust providers configured")
+		}
+		return fmt.Errorf("failed to verify peer certificate against trust store for host %v: %v", host, lastErr)
+	}
+
+	// Chain+hostname verification passed; also enforce identity pinning, if
+	// configured, as an additional restriction on top.
+	if err := verifyAllowedIdentity(certs[0], w.hConfig.Edge.AllowedServerCNs, w.hConfig.Edge.AllowedServerHostnames); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// trustStoreDirs returns the set of directories that should be watched for
+// changes: the CA certs directory itself, plus the parent directory of each
+// single-file trust source (fsnotify watches directories, not files, so that
+// it still sees events for atomic renames used by cert-rotation tooling).
+func (w *TrustStoreWatcher) trustStoreDirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+
+	add := func(path string) {
+		if path == "" {
+			return
+		}
+		info, err := os.Stat(path)
+		dir := path
+		if err == nil && !info.IsDir() {
+			dir = filepath.Dir(path)
+		} else if err != nil {
+			dir = filepath.Dir(path)
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	add(w.hConfig.Edge.CACertsPath)
+
+	mhCertPath := os.Getenv(OldMgmtHubCertPath)
+	if mhCertPath == "" {
+		mhCertPath = os.Getenv(ManagementHubCertPath)
+	}
+	add(mhCertPath)
+
+	add(w.hConfig.AgreementBot.CSSSSLCert)
+
+	return dirs
+}
+
+// pollInterval returns the configured fallback poll interval, falling back
+// to defaultTrustStorePollIntervalS when unset.
+func (w *TrustStoreWatcher) pollInterval() time.Duration {
+	if w.hConfig.Edge.TrustStorePollIntervalS > 0 {
+		return time.Duration(w.hConfig.Edge.TrustStorePollIntervalS) * time.Second
+	}
+	return defaultTrustStorePollIntervalS * time.Second
+}
+
+// run watches the trust store directories for changes and falls back to
+// polling on a timer for filesystems where fsnotify doesn't delivery timely
+// (or any) events.
+func (w *TrustStoreWatcher) run() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Errorf("TrustStoreWatcher: failed to start fsnotify watcher, falling back to polling only: %v", err)
+	} else {
+		defer watcher.Close()
+		for _, dir := range w.watchDirs {
+			if err := watcher.Add(dir); err != nil {
+				glog.Warningf("TrustStoreWatcher: failed to watch %v, relying on poll fallback: %v", dir, err)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(w.pollInterval())
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.reload()
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			glog.Warningf("TrustStoreWatcher: fsnotify error: %v", err)
+		case <-ticker.C:
+			w.reload()
+		}
+	}
+}
+
+// reload asks every provider to rebuild its pool and swaps each one in on
+// success. A provider that fails to reload keeps its previous pool in
+// place, and the failure is recorded for LastReloadErr.
+func (w *TrustStoreWatcher) reload() {
+	newPools := make([]*x509.CertPool, len(w.providers))
+	var reloadErr error
+
+	for i, p := range w.providers {
+		pool, err := p.RootCAs(context.Background())
+		if err != nil {
+			reloadErr = err
+			glog.Errorf("TrustStoreWatcher: failed to reload trust pool from provider %T: %v", p, err)
+			continue
+		}
+		newPools[i] = pool
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, pool := range newPools {
+		if pool != nil {
+			w.pools[i] = pool
+		}
+	}
+	w.lastErr = reloadErr
+
+	if reloadErr == nil {
+		glog.V(3).Infof("TrustStoreWatcher: reloaded CA trust store from %v", w.watchDirs)
+	}
+}
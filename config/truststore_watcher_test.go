@@ -0,0 +1,126 @@
+package config
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert builds a self-signed leaf certificate valid for dnsName,
+// and a *x509.CertPool trusting it, for use as test fixtures.
+func selfSignedCert(t *testing.T, dnsName string) (*x509.Certificate, []byte, *x509.CertPool) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create test cert: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse test cert: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return cert, der, pool
+}
+
+func TestTrustStoreWatcherVerifyPeerCertificate(t *testing.T) {
+	_, der, pool := selfSignedCert(t, "exchange.example.com")
+
+	w := &TrustStoreWatcher{
+		pools: []*x509.CertPool{pool},
+	}
+
+	if err := w.verifyPeerCertificate([][]byte{der}, "exchange.example.com"); err != nil {
+		t.Errorf("expected cert valid for the dialed host to be accepted, got: %v", err)
+	}
+
+	if err := w.verifyPeerCertificate([][]byte{der}, "attacker.example.com"); err == nil {
+		t.Errorf("expected cert valid for a different host to be rejected when dialing attacker.example.com, but it was accepted")
+	}
+}
+
+func TestTrustStoreWatcherVerifyPeerCertificateIdentityPinning(t *testing.T) {
+	_, der, pool := selfSignedCert(t, "exchange.example.com")
+
+	w := &TrustStoreWatcher{
+		pools: []*x509.CertPool{pool},
+		hConfig: HorizonConfig{
+			Edge: Edge{
+				AllowedServerCNs: []string{"someone-else.example.com"},
+			},
+		},
+	}
+
+	if err := w.verifyPeerCertificate([][]byte{der}, "exchange.example.com"); err == nil {
+		t.Errorf("expected cert to be rejected: it passes hostname verification but its CN isn't in AllowedServerCNs")
+	}
+
+	w.hConfig.Edge.AllowedServerCNs = []string{"exchange.example.com"}
+	if err := w.verifyPeerCertificate([][]byte{der}, "exchange.example.com"); err != nil {
+		t.Errorf("expected cert to be accepted once its CN is in AllowedServerCNs, got: %v", err)
+	}
+}
+
+func TestHostTLSDialerFallsBackForUnmatchedHost(t *testing.T) {
+	fallbackCalled := false
+	fallback := func(_ context.Context, _, addr string) (net.Conn, error) {
+		fallbackCalled = true
+		return nil, nil
+	}
+
+	d := &hostTLSDialer{
+		fallback: fallback,
+		profiles: map[string]*hostProfileTrust{
+			"css.example.com": {},
+		},
+	}
+
+	if _, err := d.DialTLSContext(context.Background(), "tcp", "exchange.example.com:443"); err != nil {
+		t.Fatalf("unexpected error from stub fallback: %v", err)
+	}
+	if !fallbackCalled {
+		t.Errorf("expected a host with no matching profile to fall back to the default dialer")
+	}
+}
+
+func TestNormalizeHostKey(t *testing.T) {
+	cases := map[string]string{
+		"css.example.com":               "css.example.com",
+		"css.example.com:9443":          "css.example.com",
+		"https://css.example.com":       "css.example.com",
+		"https://css.example.com/":      "css.example.com",
+		"https://css.example.com:9443/": "css.example.com",
+	}
+
+	for in, want := range cases {
+		if got := normalizeHostKey(in); got != want {
+			t.Errorf("normalizeHostKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}